@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Principal identifies the party behind a websocket connection, as
+// resolved by a ConnectionAuthenticator.
+type Principal struct {
+	ID string
+}
+
+// ConnectionAuthenticator resolves the Principal behind an incoming HTTP
+// upgrade request, or rejects the connection outright.
+type ConnectionAuthenticator interface {
+	AuthenticateConnection(r *http.Request) (Principal, error)
+}
+
+// Authorizer decides whether a Principal may perform action on topic.
+type Authorizer interface {
+	Authorize(p Principal, action PubOrSub, topic string) bool
+}
+
+// Authenticator combines connection authentication and per-action
+// authorization. It is consulted once per connection (to admit the
+// upgrade) and once per sub/pub/unsub message (to admit the action).
+type Authenticator interface {
+	ConnectionAuthenticator
+	Authorizer
+}
+
+// CombinedAuthenticator builds an Authenticator out of an independently
+// pluggable ConnectionAuthenticator and Authorizer, so the two concerns can
+// be mixed and matched (e.g. TokenAuthenticator + StaticACLAuthorizer).
+type CombinedAuthenticator struct {
+	ConnectionAuthenticator
+	Authorizer
+}
+
+// AllowAllAuthenticator accepts every connection and permits every action.
+// It is the default, preserving the server's historical open-access
+// behaviour for callers that don't need auth.
+type AllowAllAuthenticator struct{}
+
+func (AllowAllAuthenticator) AuthenticateConnection(*http.Request) (Principal, error) {
+	return Principal{}, nil
+}
+
+func (AllowAllAuthenticator) Authorize(Principal, PubOrSub, string) bool {
+	return true
+}
+
+// TokenAuthenticator authenticates connections using a bearer token found
+// in the "token" query parameter or an "Authorization: Bearer <token>"
+// header. It does not authorize actions on its own; pair it with an
+// Authorizer via CombinedAuthenticator.
+type TokenAuthenticator struct {
+	// Tokens maps accepted tokens to the Principal they authenticate as.
+	Tokens map[string]Principal
+}
+
+func (a TokenAuthenticator) AuthenticateConnection(r *http.Request) (Principal, error) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			return Principal{}, errors.New("auth: invalid or missing token")
+		}
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+	p, ok := a.Tokens[token]
+	if !ok {
+		return Principal{}, errors.New("auth: invalid or missing token")
+	}
+	return p, nil
+}
+
+// ACLRule grants a principal the listed actions on topics matching
+// TopicGlob (as matched by path.Match).
+type ACLRule struct {
+	TopicGlob string
+	Actions   []PubOrSub
+}
+
+// StaticACLAuthorizer authorizes actions against a static, per-principal
+// set of topic-glob rules. Unmatched principals or actions are denied.
+type StaticACLAuthorizer struct {
+	Rules map[string][]ACLRule
+}
+
+func (a StaticACLAuthorizer) Authorize(p Principal, action PubOrSub, topic string) bool {
+	for _, rule := range a.Rules[p.ID] {
+		matched, err := path.Match(rule.TopicGlob, topic)
+		if err != nil || !matched {
+			continue
+		}
+		for _, allowed := range rule.Actions {
+			if allowed == action {
+				return true
+			}
+		}
+	}
+	return false
+}
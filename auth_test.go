@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenAuthenticatorAuthenticateConnection(t *testing.T) {
+	auth := TokenAuthenticator{Tokens: map[string]Principal{"secret": {ID: "alice"}}}
+
+	r := httptest.NewRequest("GET", "/ws?token=secret", nil)
+	p, err := auth.AuthenticateConnection(r)
+	if err != nil {
+		t.Fatalf("query param: AuthenticateConnection: %v", err)
+	}
+	if p.ID != "alice" {
+		t.Errorf("query param: principal = %+v, want alice", p)
+	}
+
+	r = httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	p, err = auth.AuthenticateConnection(r)
+	if err != nil {
+		t.Fatalf("header: AuthenticateConnection: %v", err)
+	}
+	if p.ID != "alice" {
+		t.Errorf("header: principal = %+v, want alice", p)
+	}
+
+	r = httptest.NewRequest("GET", "/ws?token=wrong", nil)
+	if _, err := auth.AuthenticateConnection(r); err == nil {
+		t.Error("expected error for invalid token")
+	}
+
+	r = httptest.NewRequest("GET", "/ws", nil)
+	if _, err := auth.AuthenticateConnection(r); err == nil {
+		t.Error("expected error for missing token")
+	}
+}
+
+func TestStaticACLAuthorizerAuthorize(t *testing.T) {
+	authz := StaticACLAuthorizer{
+		Rules: map[string][]ACLRule{
+			"alice": {{TopicGlob: "room.*", Actions: []PubOrSub{sub, pub}}},
+		},
+	}
+	alice := Principal{ID: "alice"}
+
+	if !authz.Authorize(alice, sub, "room.42") {
+		t.Error("expected alice to be allowed to sub on room.42")
+	}
+	if !authz.Authorize(alice, pub, "room.42") {
+		t.Error("expected alice to be allowed to pub on room.42")
+	}
+	if authz.Authorize(alice, unsub, "room.42") {
+		t.Error("expected alice to be denied unsub, which isn't in Actions")
+	}
+	if authz.Authorize(alice, sub, "other") {
+		t.Error("expected alice to be denied on a topic that doesn't match the glob")
+	}
+	if authz.Authorize(Principal{ID: "bob"}, sub, "room.42") {
+		t.Error("expected a principal with no rules to be denied")
+	}
+}
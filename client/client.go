@@ -0,0 +1,506 @@
+// Package client provides a reconnecting websocket client for the
+// wspubsubgo pub/sub protocol.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed to write a message to the peer.
+	writeWait = 10 * time.Second
+
+	// Time allowed to read the next pong message from the peer.
+	pongWait = 60 * time.Second
+
+	// Send pings to peer with this period. Must be less than pongWait.
+	pingPeriod = (pongWait * 9) / 10
+
+	// Bounds for the reconnect backoff.
+	minReconnectBackoff = 1 * time.Second
+	maxReconnectBackoff = 30 * time.Second
+
+	// Default number of publish attempts buffered while disconnected.
+	defaultPublishBufferSize = 64
+)
+
+// PubOrSub mirrors the server's action enum.
+type PubOrSub int8
+
+const (
+	unsub PubOrSub = iota - 1
+	pub
+	sub
+	// ack and err are server-originated actions, correlated to a request
+	// by ID, reporting that a sub/pub/unsub either committed or failed.
+	ack
+	errAction
+)
+
+// message mirrors the wire format used by the server.
+type message struct {
+	// ID correlates a request with the server's ack/err response. Only
+	// set by PublishSync; Publish and Subscribe/Unsubscribe leave it
+	// empty and get no response.
+	ID      string      `json:"id,omitempty"`
+	Action  PubOrSub    `json:"action"`
+	Topic   string      `json:"topic"`
+	Payload interface{} `json:"payload"`
+}
+
+// ErrNotConnected is returned by Publish when the client is disconnected and
+// the publish buffer is full.
+var ErrNotConnected = errors.New("client: not connected and publish buffer is full")
+
+// ErrClosed is returned by calls made after Stop.
+var ErrClosed = errors.New("client: closed")
+
+// ErrAckTimeout is returned by PublishSync when the server does not
+// respond within the given timeout.
+var ErrAckTimeout = errors.New("client: timed out waiting for ack")
+
+// Config configures a WSClient. The zero value uses sane defaults.
+type Config struct {
+	// PublishBufferSize bounds how many publishes are buffered while the
+	// client is disconnected. Defaults to defaultPublishBufferSize.
+	PublishBufferSize int
+
+	// Header is sent with the initial (and every reconnect) handshake.
+	Header http.Header
+}
+
+// WSClient is a reconnecting websocket client that speaks the server's
+// message{Action, Topic, Payload} protocol. It runs internal read/write
+// pumps mirroring the server's readPump/writePump, including ping/pong
+// keepalive, and transparently redials on disconnect with exponential
+// backoff, re-issuing all active subscriptions once reconnected.
+type WSClient struct {
+	url    string
+	header http.Header
+
+	publishBufferSize int
+
+	idSeq uint64
+
+	mu            sync.Mutex
+	conn          *websocket.Conn
+	subscriptions map[string]chan message
+	acks          map[string]chan error
+	pending       []message
+	closed        bool
+
+	send    chan message
+	ctrlMu  sync.Mutex
+	ctrl    []message
+	ctrlSig chan struct{}
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New creates a WSClient that will dial url once Start is called.
+func New(url string, cfg Config) *WSClient {
+	bufSize := cfg.PublishBufferSize
+	if bufSize <= 0 {
+		bufSize = defaultPublishBufferSize
+	}
+	return &WSClient{
+		url:               url,
+		header:            cfg.Header,
+		publishBufferSize: bufSize,
+		subscriptions:     make(map[string]chan message),
+		acks:              make(map[string]chan error),
+		send:              make(chan message, bufSize),
+		ctrlSig:           make(chan struct{}, 1),
+		done:              make(chan struct{}),
+	}
+}
+
+// nextID returns a new, connection-lifetime-unique correlation ID.
+func (c *WSClient) nextID() string {
+	return strconv.FormatUint(atomic.AddUint64(&c.idSeq, 1), 10)
+}
+
+// Start dials the server and begins the reconnect loop in the background.
+func (c *WSClient) Start() error {
+	c.wg.Add(1)
+	go c.reconnectLoop()
+	return nil
+}
+
+// Stop closes the connection and stops the reconnect loop.
+func (c *WSClient) Stop() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	close(c.done)
+	c.mu.Lock()
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+	c.mu.Unlock()
+	c.wg.Wait()
+}
+
+// Subscribe issues a subscribe request for topic and returns a channel that
+// receives the messages published to it. The channel holds up to
+// PublishBufferSize messages; a message arriving while it is full is
+// dropped. The subscription is re-issued automatically after a reconnect.
+func (c *WSClient) Subscribe(topic string) (<-chan message, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	ch, ok := c.subscriptions[topic]
+	if !ok {
+		ch = make(chan message, c.publishBufferSize)
+		c.subscriptions[topic] = ch
+	}
+	c.mu.Unlock()
+
+	c.enqueue(message{Action: sub, Topic: topic})
+	return ch, nil
+}
+
+// Unsubscribe cancels a previous Subscribe and closes its channel. The
+// delete-from-map and close happen under the same lock dispatch uses to
+// look up and send on the channel, so dispatch can never observe the topic
+// as subscribed and then send on an already-closed channel.
+func (c *WSClient) Unsubscribe(topic string) {
+	c.mu.Lock()
+	ch, ok := c.subscriptions[topic]
+	if ok {
+		delete(c.subscriptions, topic)
+		close(ch)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	c.enqueue(message{Action: unsub, Topic: topic})
+}
+
+// Publish sends payload to topic, buffering the attempt while disconnected
+// up to PublishBufferSize entries.
+func (c *WSClient) Publish(topic string, payload interface{}) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.mu.Unlock()
+
+	select {
+	case c.send <- message{Action: pub, Topic: topic, Payload: payload}:
+		return nil
+	default:
+		return ErrNotConnected
+	}
+}
+
+// PublishSync behaves like Publish, but blocks until the server acks or
+// rejects the publish, or timeout elapses. It relies on the request/response
+// correlation IDs the server attaches ack/err responses to.
+func (c *WSClient) PublishSync(topic string, payload interface{}, timeout time.Duration) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	id := c.nextID()
+	ackCh := make(chan error, 1)
+	c.acks[id] = ackCh
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.acks, id)
+		c.mu.Unlock()
+	}()
+
+	select {
+	case c.send <- message{ID: id, Action: pub, Topic: topic, Payload: payload}:
+	default:
+		return ErrNotConnected
+	}
+
+	select {
+	case err := <-ackCh:
+		return err
+	case <-time.After(timeout):
+		return ErrAckTimeout
+	case <-c.done:
+		return ErrClosed
+	}
+}
+
+// enqueue is used for control messages (sub/unsub) which should never be
+// dropped silently the way a best-effort publish can be. Unlike c.send,
+// which is a bounded channel writePump drains, the control queue is an
+// unbounded slice: enqueue never blocks, so it's safe to call before
+// writePump exists (e.g. resubscribe, which runs before each connection's
+// writePump starts, or Subscribe called more times than PublishBufferSize
+// before the first connection).
+func (c *WSClient) enqueue(m message) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+
+	c.ctrlMu.Lock()
+	c.ctrl = append(c.ctrl, m)
+	c.ctrlMu.Unlock()
+
+	select {
+	case c.ctrlSig <- struct{}{}:
+	default:
+	}
+}
+
+// drainCtrl returns and clears every control message queued by enqueue.
+func (c *WSClient) drainCtrl() []message {
+	c.ctrlMu.Lock()
+	defer c.ctrlMu.Unlock()
+	ctrl := c.ctrl
+	c.ctrl = nil
+	return ctrl
+}
+
+// reconnectLoop dials the server, runs the pumps until they exit, then
+// redials with exponential backoff until Stop is called.
+func (c *WSClient) reconnectLoop() {
+	defer c.wg.Done()
+
+	backoff := minReconnectBackoff
+	for {
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+
+		conn, _, err := websocket.DefaultDialer.Dial(c.url, c.header)
+		if err != nil {
+			log.Printf("client: dial error: %v\n", err)
+			select {
+			case <-time.After(backoff):
+			case <-c.done:
+				return
+			}
+			backoff *= 2
+			if backoff > maxReconnectBackoff {
+				backoff = maxReconnectBackoff
+			}
+			continue
+		}
+
+		backoff = minReconnectBackoff
+		c.mu.Lock()
+		c.conn = conn
+		c.mu.Unlock()
+
+		c.resubscribe()
+
+		var pumps sync.WaitGroup
+		pumps.Add(2)
+		go func() {
+			defer pumps.Done()
+			c.readPump(conn)
+		}()
+		go func() {
+			defer pumps.Done()
+			c.writePump(conn)
+		}()
+		pumps.Wait()
+
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+	}
+}
+
+// resubscribe re-issues a subscribe request for every topic that was active
+// before the reconnect.
+func (c *WSClient) resubscribe() {
+	c.mu.Lock()
+	topics := make([]string, 0, len(c.subscriptions))
+	for topic := range c.subscriptions {
+		topics = append(topics, topic)
+	}
+	c.mu.Unlock()
+
+	for _, topic := range topics {
+		c.enqueue(message{Action: sub, Topic: topic})
+	}
+}
+
+// readPump pumps messages from the websocket connection to the subscribed
+// topic channels. It mirrors the server's readPump ping/pong handling.
+func (c *WSClient) readPump(conn *websocket.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		for _, m := range decodeFrame(data) {
+			c.dispatch(m)
+		}
+	}
+}
+
+// decodeFrame parses a server frame into the messages it carries. The
+// server may coalesce several messages per frame as a JSON array
+// (FramingArray), newline-delimited (FramingNDJSON), or send one message
+// per frame (FramingSingle); this accepts all three.
+func decodeFrame(data []byte) []message {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return nil
+	}
+
+	if trimmed[0] == '[' {
+		var batch []message
+		if err := json.Unmarshal(trimmed, &batch); err != nil {
+			log.Printf("client: malformed array frame: %v\n", err)
+			return nil
+		}
+		return batch
+	}
+
+	var out []message
+	for _, line := range bytes.Split(trimmed, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var m message
+		if err := json.Unmarshal(line, &m); err != nil {
+			log.Printf("client: malformed frame: %v\n", err)
+			continue
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// dispatch routes a decoded message either to the PublishSync call it
+// acknowledges, or to its topic's subscriber channel.
+func (c *WSClient) dispatch(m message) {
+	if m.ID != "" && (m.Action == ack || m.Action == errAction) {
+		c.mu.Lock()
+		ackCh, ok := c.acks[m.ID]
+		c.mu.Unlock()
+		if !ok {
+			return
+		}
+		if m.Action == errAction {
+			reason, _ := m.Payload.(string)
+			ackCh <- errors.New(reason)
+		} else {
+			ackCh <- nil
+		}
+		return
+	}
+
+	// Hold the lock across the lookup and the send so Unsubscribe can't
+	// close ch between the two: Unsubscribe deletes-and-closes under the
+	// same lock, so seeing the topic here means ch is not yet closed.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.subscriptions[m.Topic]
+	if !ok {
+		return
+	}
+	select {
+	case ch <- m:
+	default:
+		log.Printf("client: dropping message for slow subscriber on %q\n", m.Topic)
+	}
+}
+
+// writePump pumps queued publish/control messages to the websocket
+// connection and sends periodic pings, mirroring the server's writePump.
+func (c *WSClient) writePump(conn *websocket.Conn) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for _, m := range c.drainPending() {
+		if !c.writeOne(conn, m) {
+			return
+		}
+	}
+	for _, m := range c.drainCtrl() {
+		if !c.writeOne(conn, m) {
+			return
+		}
+	}
+
+	for {
+		select {
+		case m := <-c.send:
+			if !c.writeOne(conn, m) {
+				c.mu.Lock()
+				c.pending = append(c.pending, m)
+				c.mu.Unlock()
+				return
+			}
+		case <-c.ctrlSig:
+			for _, m := range c.drainCtrl() {
+				if !c.writeOne(conn, m) {
+					return
+				}
+			}
+		case <-ticker.C:
+			_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-c.done:
+			_ = conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		}
+	}
+}
+
+func (c *WSClient) writeOne(conn *websocket.Conn, m message) bool {
+	_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := conn.WriteJSON(m); err != nil {
+		log.Printf("client: write error: %v\n", err)
+		return false
+	}
+	return true
+}
+
+func (c *WSClient) drainPending() []message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := c.pending
+	c.pending = nil
+	return pending
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentSubscribeUnsubscribeDispatch exercises Subscribe/Unsubscribe
+// racing against dispatch on the same topic under the race detector. Before
+// Unsubscribe closed its channel under the same lock dispatch uses to look
+// it up, this could panic with "send on closed channel".
+func TestConcurrentSubscribeUnsubscribeDispatch(t *testing.T) {
+	c := New("ws://example.invalid", Config{})
+
+	stop := make(chan struct{})
+	go func() {
+		// Stand in for writePump, which would otherwise drain c.send.
+		for {
+			select {
+			case <-c.send:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	const rounds = 500
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			if _, err := c.Subscribe("topic"); err != nil {
+				t.Errorf("Subscribe: %v", err)
+				return
+			}
+			c.Unsubscribe("topic")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			c.dispatch(message{Topic: "topic", Action: pub, Payload: i})
+		}
+	}()
+	wg.Wait()
+	close(stop)
+}
+
+// TestSubscribeBeyondBufferSizeBeforeStart exercises enqueue's unbounded
+// control queue: before the fix, Subscribe called more times than
+// PublishBufferSize, with nothing ever draining c.send (Start not yet
+// called), blocked forever on the bufSize+1'th call.
+func TestSubscribeBeyondBufferSizeBeforeStart(t *testing.T) {
+	c := New("ws://example.invalid", Config{PublishBufferSize: 4})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			if _, err := c.Subscribe("topic"); err != nil {
+				t.Errorf("Subscribe: %v", err)
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Subscribe blocked past PublishBufferSize with nothing draining c.send")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// clientSet is the set of clients subscribed to a topic.
+type clientSet map[*Client]struct{}
+
+// topicOp is a (un)subscribe request routed through the hub's channels.
+type topicOp struct {
+	topic  string
+	client *Client
+}
+
+// publishOp is a publish request routed through the hub's broadcast channel.
+type publishOp struct {
+	topic   string
+	message message
+}
+
+// statsRequest asks the hub's Run goroutine for a point-in-time Stats
+// snapshot, so reads are serialized the same way writes are.
+type statsRequest struct {
+	resp chan Stats
+}
+
+// Stats is a point-in-time snapshot of a Hub's bookkeeping.
+type Stats struct {
+	ClientCount           int
+	MessagesPublished     uint64
+	DroppedSlowConsumers  uint64
+	TopicSubscriberCounts map[string]int
+}
+
+// Hub owns all topic-subscription state. Every mutation (register,
+// unregister, subscribe, unsubscribe, broadcast) is serialized through Run,
+// so the topic map itself needs no locks.
+type Hub struct {
+	register   chan *Client
+	unregister chan *Client
+	subscribe  chan topicOp
+	unsub      chan topicOp
+	broadcast  chan publishOp
+	statsReq   chan statsRequest
+
+	clients clientSet
+	topics  map[string]clientSet
+
+	messagesPublished    uint64
+	droppedSlowConsumers uint64
+}
+
+// NewHub creates a Hub. Call Run, in its own goroutine, before registering
+// any client.
+func NewHub() *Hub {
+	return &Hub{
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		subscribe:  make(chan topicOp),
+		unsub:      make(chan topicOp),
+		broadcast:  make(chan publishOp),
+		statsReq:   make(chan statsRequest),
+		clients:    make(clientSet),
+		topics:     make(map[string]clientSet),
+	}
+}
+
+// Run services the hub's channels and never returns. It must run in its own
+// goroutine for the lifetime of the server.
+func (h *Hub) Run() {
+	for {
+		select {
+		case c := <-h.register:
+			h.clients[c] = struct{}{}
+		case c := <-h.unregister:
+			h.removeClient(c)
+		case op := <-h.subscribe:
+			set, ok := h.topics[op.topic]
+			if !ok {
+				set = make(clientSet)
+				h.topics[op.topic] = set
+			}
+			set[op.client] = struct{}{}
+		case op := <-h.unsub:
+			if set, ok := h.topics[op.topic]; ok {
+				delete(set, op.client)
+				if len(set) == 0 {
+					delete(h.topics, op.topic)
+				}
+			}
+		case op := <-h.broadcast:
+			h.publish(op.topic, op.message)
+		case req := <-h.statsReq:
+			req.resp <- h.snapshot()
+		}
+	}
+}
+
+// Register admits c to the hub. serveWs calls this once per connection,
+// before starting the client's pumps.
+func (h *Hub) Register(c *Client) {
+	h.register <- c
+}
+
+// RemoveClient unregisters c and drops it from every topic it was
+// subscribed to, closing its send channel so writePump exits. It is safe to
+// call more than once for the same client.
+func (h *Hub) RemoveClient(c *Client) {
+	h.unregister <- c
+}
+
+// Subscribe adds c as a subscriber of topic.
+func (h *Hub) Subscribe(topic string, c *Client) {
+	h.subscribe <- topicOp{topic: topic, client: c}
+}
+
+// UnSubscribe removes c as a subscriber of topic.
+func (h *Hub) UnSubscribe(topic string, c *Client) {
+	h.unsub <- topicOp{topic: topic, client: c}
+}
+
+// Publish fans m out to every subscriber of topic.
+func (h *Hub) Publish(topic string, m message) {
+	h.broadcast <- publishOp{topic: topic, message: m}
+}
+
+// Stats returns a point-in-time snapshot of the hub's bookkeeping.
+func (h *Hub) Stats() Stats {
+	resp := make(chan Stats, 1)
+	h.statsReq <- statsRequest{resp: resp}
+	return <-resp
+}
+
+// removeClient is only ever called from the Run goroutine.
+func (h *Hub) removeClient(c *Client) {
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	delete(h.clients, c)
+	for topic, set := range h.topics {
+		if _, ok := set[c]; ok {
+			delete(set, c)
+			if len(set) == 0 {
+				delete(h.topics, topic)
+			}
+		}
+	}
+	c.closeSend()
+}
+
+// publish is only ever called from the Run goroutine. A client whose send
+// channel is full (trySend fails) is treated as a slow consumer: it is
+// disconnected rather than allowed to block delivery to every other
+// subscriber.
+func (h *Hub) publish(topic string, m message) {
+	h.messagesPublished++
+	set, ok := h.topics[topic]
+	if !ok {
+		return
+	}
+	payload, err := json.Marshal(m)
+	if err != nil {
+		log.Printf("hub: failed to marshal message for %q: %v\n", topic, err)
+		return
+	}
+
+	for c := range set {
+		if !c.trySend(payload) {
+			log.Printf("%s> slow consumer on %q, disconnecting\n", c.name, topic)
+			h.droppedSlowConsumers++
+			h.removeClient(c)
+		}
+	}
+}
+
+// snapshot is only ever called from the Run goroutine.
+func (h *Hub) snapshot() Stats {
+	counts := make(map[string]int, len(h.topics))
+	for topic, set := range h.topics {
+		counts[topic] = len(set)
+	}
+	return Stats{
+		ClientCount:           len(h.clients),
+		MessagesPublished:     h.messagesPublished,
+		DroppedSlowConsumers:  h.droppedSlowConsumers,
+		TopicSubscriberCounts: counts,
+	}
+}
+
+// MetricsHandler returns an http.Handler exposing the hub's Stats in
+// Prometheus text exposition format, suitable for mounting at /metrics.
+func (h *Hub) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := h.Stats()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		fmt.Fprintln(w, "# HELP wspubsub_clients_connected Number of currently connected clients.")
+		fmt.Fprintln(w, "# TYPE wspubsub_clients_connected gauge")
+		fmt.Fprintf(w, "wspubsub_clients_connected %d\n", stats.ClientCount)
+
+		fmt.Fprintln(w, "# HELP wspubsub_messages_published_total Total messages published through the hub.")
+		fmt.Fprintln(w, "# TYPE wspubsub_messages_published_total counter")
+		fmt.Fprintf(w, "wspubsub_messages_published_total %d\n", stats.MessagesPublished)
+
+		fmt.Fprintln(w, "# HELP wspubsub_dropped_slow_consumers_total Clients disconnected for lagging behind their send buffer.")
+		fmt.Fprintln(w, "# TYPE wspubsub_dropped_slow_consumers_total counter")
+		fmt.Fprintf(w, "wspubsub_dropped_slow_consumers_total %d\n", stats.DroppedSlowConsumers)
+
+		fmt.Fprintln(w, "# HELP wspubsub_topic_subscribers Number of subscribers for a topic.")
+		fmt.Fprintln(w, "# TYPE wspubsub_topic_subscribers gauge")
+		for topic, count := range stats.TopicSubscriberCounts {
+			fmt.Fprintf(w, "wspubsub_topic_subscribers{topic=%q} %d\n", topic, count)
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+// newTestClient builds a Client with no real websocket connection, which is
+// fine here: Hub never touches Client.conn, only name, send and the
+// sendMu/closed pair guarding send.
+func newTestClient(name string, sendBuf int) *Client {
+	return &Client{name: name, send: make(chan []byte, sendBuf)}
+}
+
+func TestHubSlowConsumerEviction(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+
+	c := newTestClient("slow", 1)
+	h.Register(c)
+	h.Subscribe("topic", c)
+
+	// The first publish fills the client's single-slot send buffer since
+	// nothing drains it. The second finds the buffer full and should
+	// evict the client instead of blocking the hub.
+	h.Publish("topic", message{Action: pub, Topic: "topic", Payload: "1"})
+	h.Publish("topic", message{Action: pub, Topic: "topic", Payload: "2"})
+
+	stats := h.Stats()
+	if stats.DroppedSlowConsumers != 1 {
+		t.Fatalf("DroppedSlowConsumers = %d, want 1", stats.DroppedSlowConsumers)
+	}
+	if stats.ClientCount != 0 {
+		t.Errorf("ClientCount = %d, want 0 after eviction", stats.ClientCount)
+	}
+	if count := stats.TopicSubscriberCounts["topic"]; count != 0 {
+		t.Errorf("TopicSubscriberCounts[topic] = %d, want 0 after eviction", count)
+	}
+
+	for {
+		_, ok := <-c.send
+		if !ok {
+			break
+		}
+	}
+}
+
+func TestHubStatsTopicSubscriberCounts(t *testing.T) {
+	h := NewHub()
+	go h.Run()
+
+	a := newTestClient("a", 4)
+	b := newTestClient("b", 4)
+	h.Register(a)
+	h.Register(b)
+	h.Subscribe("topic", a)
+	h.Subscribe("topic", b)
+
+	stats := h.Stats()
+	if stats.ClientCount != 2 {
+		t.Errorf("ClientCount = %d, want 2", stats.ClientCount)
+	}
+	if got := stats.TopicSubscriberCounts["topic"]; got != 2 {
+		t.Errorf("TopicSubscriberCounts[topic] = %d, want 2", got)
+	}
+
+	h.UnSubscribe("topic", a)
+
+	stats = h.Stats()
+	if got := stats.TopicSubscriberCounts["topic"]; got != 1 {
+		t.Errorf("TopicSubscriberCounts[topic] = %d, want 1 after unsubscribe", got)
+	}
+}
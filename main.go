@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+)
+
+// addr is the address the pub/sub server listens on.
+var addr = flag.String("addr", ":8080", "http service address")
+
+func main() {
+	flag.Parse()
+
+	hub := NewHub()
+	go hub.Run()
+
+	cfg := DefaultConfig()
+	auth := AllowAllAuthenticator{}
+
+	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		serveWs(hub, cfg, auth, w, r)
+	})
+	http.Handle("/metrics", hub.MetricsHandler())
+
+	log.Printf("listening on %s\n", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
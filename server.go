@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"github.com/gorilla/websocket"
+	"io"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -16,21 +20,101 @@ const (
 
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
+
+	// Maximum message size allowed from the peer.
+	maxMessageSize = 512
+
+	// Default size of a client's outbound send channel.
+	sendChanSize = 256
+
+	defaultReadBufferSize  = 1024
+	defaultWriteBufferSize = 1024
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+// Framing controls how writePump packs multiple queued messages into a
+// single websocket frame write.
+type Framing int8
+
+const (
+	// FramingArray packs queued messages into a single `[msg,msg,...]`
+	// JSON array, written as one websocket text message. This is the
+	// default: unlike the historical concatenated-bytes behaviour, the
+	// result is valid JSON.
+	FramingArray Framing = iota
+
+	// FramingNDJSON packs queued messages newline-delimited inside a
+	// single websocket text message.
+	FramingNDJSON
+
+	// FramingSingle writes each queued message as its own websocket text
+	// message, never combining them.
+	FramingSingle
+)
+
+// Config tunes the per-connection limits and buffer sizes used by serveWs.
+// The zero value is not usable directly; use DefaultConfig to get sane
+// defaults and override individual fields as needed.
+type Config struct {
+	// ReadBufferSize and WriteBufferSize size the underlying websocket
+	// connection's I/O buffers.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// SendChanSize bounds how many outbound messages are queued for a
+	// client. A client whose queue is full when the hub fans out a publish
+	// is disconnected as a slow consumer.
+	SendChanSize int
+
+	// MaxMessageSize is the largest message, in bytes, accepted from a
+	// peer. Larger messages cause the connection to be closed with a
+	// CloseMessageTooBig frame.
+	MaxMessageSize int64
+
+	// WriteWait, PongWait and PingPeriod mirror the constants above but
+	// are configurable per server instance.
+	WriteWait  time.Duration
+	PongWait   time.Duration
+	PingPeriod time.Duration
+
+	// Framing controls how coalesced outbound messages are packed into a
+	// websocket frame. Defaults to FramingArray.
+	Framing Framing
+}
+
+// DefaultConfig returns the server's default Config: the buffer sizes,
+// send-channel size and timeouts the server previously hard-coded, plus a
+// 512-byte MaxMessageSize and FramingArray.
+func DefaultConfig() Config {
+	return Config{
+		ReadBufferSize:  defaultReadBufferSize,
+		WriteBufferSize: defaultWriteBufferSize,
+		SendChanSize:    sendChanSize,
+		MaxMessageSize:  maxMessageSize,
+		WriteWait:       writeWait,
+		PongWait:        pongWait,
+		PingPeriod:      pingPeriod,
+		Framing:         FramingArray,
+	}
 }
 
-// Client is a middleman between the websocket connection and the subscription.
+// Client is a middleman between the websocket connection and the hub.
 type Client struct {
 	name string
 	conn *websocket.Conn
 	send chan []byte
+	cfg  Config
+
+	// principal is resolved once, at connection time, and cached for the
+	// lifetime of the connection, so per-message authorization only calls
+	// auth.Authorize and never repeats AuthenticateConnection.
+	principal Principal
+	auth      Authorizer
+
+	// sendMu guards closed and serializes every send on send against the
+	// hub closing it, so a sendAck/sendErr from readPump's goroutine can
+	// never race Hub.removeClient's close(c.send).
+	sendMu sync.Mutex
+	closed bool
 }
 
 type PubOrSub int8
@@ -39,26 +123,97 @@ const (
 	unsub PubOrSub = iota - 1
 	pub
 	sub
+	// ack and err are server-originated actions, pushed back to a client
+	// that set an ID on its sub/pub/unsub request, once the action has
+	// been committed (ack) or failed (err).
+	ack
+	errAction
 )
 
 type message struct {
+	// ID correlates a client's sub/pub/unsub request with the server's
+	// ack/err response. Left empty, the request is fire-and-forget and
+	// no response is sent on success.
+	ID      string      `json:"id,omitempty"`
 	Action  PubOrSub    `json:"action"`
 	Topic   string      `json:"topic"`
 	Payload interface{} `json:"payload"`
 }
 
-// readPump pumps messages from the websocket connection to the subscription.
+// sendAck pushes an ack message for id/topic onto the client's send
+// channel, unless id is empty (the ID-less path is fire-and-forget).
+func (c *Client) sendAck(id, topic string) {
+	if id == "" {
+		return
+	}
+	c.sendFrame(message{ID: id, Action: ack, Topic: topic})
+}
+
+// sendErr pushes an err message for id/topic carrying reason onto the
+// client's send channel, unless id is empty (the ID-less path is
+// fire-and-forget, same as sendAck).
+func (c *Client) sendErr(id, topic, reason string) {
+	if id == "" {
+		return
+	}
+	c.sendFrame(message{ID: id, Action: errAction, Topic: topic, Payload: reason})
+}
+
+// sendFrame marshals m and queues it on the client's send channel, so it is
+// written by writePump rather than racing with it on the connection.
+func (c *Client) sendFrame(m message) {
+	b, marshalErr := json.Marshal(m)
+	if marshalErr != nil {
+		log.Printf("%s> failed to marshal frame: %v\n", c.name, marshalErr)
+		return
+	}
+	if !c.trySend(b) {
+		log.Printf("%s> dropping frame, send buffer full or closed\n", c.name)
+	}
+}
+
+// trySend attempts a non-blocking send of b on c.send, guarded by sendMu so
+// it can never race Hub.removeClient's closeSend: either this observes
+// closed and gives up, or it queues b before the channel is closed.
+func (c *Client) trySend(b []byte) bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.closed {
+		return false
+	}
+	select {
+	case c.send <- b:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeSend closes c.send exactly once. It is safe to call concurrently
+// with trySend and with itself.
+func (c *Client) closeSend() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.send)
+}
+
+// readPump pumps messages from the websocket connection to the hub.
 //
 // The application runs readPump in a per-connection goroutine. The application
 // ensures that there is at most one reader on a connection by executing all
 // reads from this goroutine.
-func (c *Client) readPump(s *Subscription) {
+func (c *Client) readPump(h *Hub) {
 	defer func() {
 		_ = c.conn.Close()
 	}()
-	_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetReadLimit(c.cfg.MaxMessageSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
 	c.conn.SetPongHandler(func(string) error {
-		_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
 		return nil
 	})
 	for {
@@ -67,76 +222,114 @@ func (c *Client) readPump(s *Subscription) {
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseMessage, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNormalClosure) {
 				log.Printf("closed client error: %v\n", err)
-				s.RemoveClient(c)
+				h.RemoveClient(c)
 				break
 			}
 			if websocket.IsCloseError(err, websocket.CloseMessage, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNormalClosure) {
 				log.Printf("%s> leaving\n", c.name)
-				s.RemoveClient(c)
+				h.RemoveClient(c)
 				break
 			}
+			if errors.Is(err, websocket.ErrReadLimit) {
+				log.Printf("%s> message exceeds %d bytes, closing\n", c.name, c.cfg.MaxMessageSize)
+				_ = c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseMessageTooBig, ""))
+				h.RemoveClient(c)
+				break
+			}
+			var syntaxErr *json.SyntaxError
+			var unmarshalTypeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &unmarshalTypeErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+				// The frame itself was malformed, but NextReader already
+				// consumed it off the wire: the connection is still
+				// usable, so report the bad frame and keep reading.
+				log.Printf("%s> malformed frame, ignoring: %v\n", c.name, err)
+				continue
+			}
+			// Any other read error leaves the connection unusable:
+			// gorilla makes it permanent and panics on a repeated read,
+			// so give up on the client rather than looping back to
+			// ReadJSON.
 			log.Printf("%s> error reading message: %v\n", c.name, err)
+			h.RemoveClient(c)
+			break
 		}
 		switch wsMsg.Action {
 		case sub:
+			if !c.auth.Authorize(c.principal, sub, wsMsg.Topic) {
+				log.Printf("%s> unauthorized subscribe - %s \n", c.name, wsMsg.Topic)
+				c.sendErr(wsMsg.ID, wsMsg.Topic, "unauthorized")
+				break
+			}
 			log.Printf("%s> subscribing - %s \n", c.name, wsMsg.Topic)
-			s.Subscribe(wsMsg.Topic, c)
+			h.Subscribe(wsMsg.Topic, c)
+			c.sendAck(wsMsg.ID, wsMsg.Topic)
 			break
 		case pub:
+			if !c.auth.Authorize(c.principal, pub, wsMsg.Topic) {
+				log.Printf("%s> unauthorized publish - %s \n", c.name, wsMsg.Topic)
+				c.sendErr(wsMsg.ID, wsMsg.Topic, "unauthorized")
+				break
+			}
 			log.Printf("%s> publishing - %s \n", c.name, wsMsg.Topic)
-			s.Publish(wsMsg.Topic, wsMsg)
+			h.Publish(wsMsg.Topic, wsMsg)
+			c.sendAck(wsMsg.ID, wsMsg.Topic)
 			break
 		case unsub:
+			if !c.auth.Authorize(c.principal, unsub, wsMsg.Topic) {
+				log.Printf("%s> unauthorized unsubscribe - %s \n", c.name, wsMsg.Topic)
+				c.sendErr(wsMsg.ID, wsMsg.Topic, "unauthorized")
+				break
+			}
 			log.Printf("%s> unsubscribing - %s \n", c.name, wsMsg.Topic)
-			s.UnSubscribe(wsMsg.Topic, c)
+			h.UnSubscribe(wsMsg.Topic, c)
+			c.sendAck(wsMsg.ID, wsMsg.Topic)
 			break
 		default:
 			log.Printf("%s> unknown action %s\n", c.name, wsMsg.Topic)
+			c.sendErr(wsMsg.ID, wsMsg.Topic, "unknown action")
 			break
 		}
 	}
 }
 
-// writePump pumps messages from the subscription to the websocket connection.
+// writePump pumps messages from the hub to the websocket connection.
 //
 // A goroutine running writePump is started for each connection. The
 // application ensures that there is at most one writer to a connection by
 // executing all writes from this goroutine.
-func (c *Client) writePump(s *Subscription) {
-	ticker := time.NewTicker(pingPeriod)
+func (c *Client) writePump(h *Hub) {
+	ticker := time.NewTicker(c.cfg.PingPeriod)
 	defer func() {
 		ticker.Stop()
-		s.RemoveClient(c)
+		h.RemoveClient(c)
 		_ = c.conn.Close()
 	}()
 	for {
 		select {
 		case msg, ok := <-c.send:
-			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			_ = c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait))
 
 			if !ok {
-				// The subscription closed the channel.
+				// The hub closed the channel.
 				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			_, _ = w.Write(msg)
-
-			// Add queued messages to the current websocket message.
+			// Drain any messages queued behind msg so they can be framed
+			// together instead of trickling out one websocket frame at a
+			// time.
 			n := len(c.send)
+			queued := make([][]byte, 1, n+1)
+			queued[0] = msg
 			for i := 0; i < n; i++ {
-				_, _ = w.Write(<-c.send)
+				queued = append(queued, <-c.send)
 			}
 
-			if err = w.Close(); err != nil {
+			if !c.writeFramed(queued) {
 				return
 			}
 		case <-ticker.C:
-			err := c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err := c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait))
 			if err != nil {
 				return
 			}
@@ -147,23 +340,109 @@ func (c *Client) writePump(s *Subscription) {
 	}
 }
 
-// serveWs handles websocket requests from the peer.
-func serveWs(subscription *Subscription, w http.ResponseWriter, r *http.Request) {
+// writeFramed writes queued onto the connection according to c.cfg.Framing.
+// It returns false if the write failed and the caller should give up on the
+// connection.
+func (c *Client) writeFramed(queued [][]byte) bool {
+	switch c.cfg.Framing {
+	case FramingSingle:
+		for _, msg := range queued {
+			w, err := c.conn.NextWriter(websocket.TextMessage)
+			if err != nil {
+				return false
+			}
+			if _, err = w.Write(msg); err != nil {
+				return false
+			}
+			if err = w.Close(); err != nil {
+				return false
+			}
+		}
+		return true
+	case FramingNDJSON:
+		w, err := c.conn.NextWriter(websocket.TextMessage)
+		if err != nil {
+			return false
+		}
+		for i, msg := range queued {
+			if i > 0 {
+				if _, err = w.Write([]byte{'\n'}); err != nil {
+					return false
+				}
+			}
+			if _, err = w.Write(msg); err != nil {
+				return false
+			}
+		}
+		return w.Close() == nil
+	default: // FramingArray
+		w, err := c.conn.NextWriter(websocket.TextMessage)
+		if err != nil {
+			return false
+		}
+		if _, err = w.Write([]byte{'['}); err != nil {
+			return false
+		}
+		for i, msg := range queued {
+			if i > 0 {
+				if _, err = w.Write([]byte{','}); err != nil {
+					return false
+				}
+			}
+			if _, err = w.Write(msg); err != nil {
+				return false
+			}
+		}
+		if _, err = w.Write([]byte{']'}); err != nil {
+			return false
+		}
+		return w.Close() == nil
+	}
+}
+
+// newUpgrader builds a websocket.Upgrader sized according to cfg.
+func newUpgrader(cfg Config) websocket.Upgrader {
+	return websocket.Upgrader{
+		ReadBufferSize:  cfg.ReadBufferSize,
+		WriteBufferSize: cfg.WriteBufferSize,
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+}
+
+// serveWs handles websocket requests from the peer, using cfg to size
+// buffers and timeouts and auth to admit the connection and its
+// subscribe/publish/unsubscribe actions. Pass DefaultConfig() and
+// AllowAllAuthenticator{} to get the server's default, wide-open
+// setup.
+func serveWs(hub *Hub, cfg Config, auth Authenticator, w http.ResponseWriter, r *http.Request) {
 	defer log.Println("new client ", r.URL.Query().Get("client-name"))
+	principal, err := auth.AuthenticateConnection(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	upgrader := newUpgrader(cfg)
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	client := &Client{
-		name: r.URL.Query().Get("client-name"),
-		conn: conn,
-		send: make(chan []byte, 256),
+		name:      r.URL.Query().Get("client-name"),
+		conn:      conn,
+		send:      make(chan []byte, cfg.SendChanSize),
+		cfg:       cfg,
+		principal: principal,
+		auth:      auth,
 	}
 
+	hub.Register(client)
+
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
 	r.Header.Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
-	go client.writePump(subscription)
-	go client.readPump(subscription)
+	go client.writePump(hub)
+	go client.readPump(hub)
 }
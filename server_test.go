@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newConnPair dials a real websocket connection between two in-process
+// gorilla/websocket.Conn values, so tests can exercise readPump/writePump
+// against the real library rather than faking frames by hand.
+func newConnPair(t *testing.T) (server, client *websocket.Conn) {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	srvCh := make(chan *websocket.Conn, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		srvCh <- c
+	}))
+	t.Cleanup(ts.Close)
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+	cli, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { _ = cli.Close() })
+
+	srv := <-srvCh
+	t.Cleanup(func() { _ = srv.Close() })
+	return srv, cli
+}
+
+func TestDefaultConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	if cfg.MaxMessageSize != maxMessageSize {
+		t.Errorf("MaxMessageSize = %d, want %d", cfg.MaxMessageSize, maxMessageSize)
+	}
+	if cfg.SendChanSize != sendChanSize {
+		t.Errorf("SendChanSize = %d, want %d", cfg.SendChanSize, sendChanSize)
+	}
+	if cfg.Framing != FramingArray {
+		t.Errorf("Framing = %v, want FramingArray", cfg.Framing)
+	}
+}
+
+// TestReadPumpClosesOversizeMessage exercises the MaxMessageSize/read-limit
+// path end to end: a message over the configured limit should get the
+// connection closed with CloseMessageTooBig rather than wedging readPump.
+func TestReadPumpClosesOversizeMessage(t *testing.T) {
+	srv, cli := newConnPair(t)
+
+	h := NewHub()
+	go h.Run()
+
+	cfg := DefaultConfig()
+	cfg.MaxMessageSize = 8
+
+	c := &Client{name: "big", conn: srv, send: make(chan []byte, cfg.SendChanSize), cfg: cfg, auth: AllowAllAuthenticator{}}
+	h.Register(c)
+	go c.writePump(h)
+	go c.readPump(h)
+
+	if err := cli.WriteJSON(message{Action: pub, Topic: "t", Payload: "this payload is definitely too big"}); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+
+	_ = cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := cli.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok {
+		t.Fatalf("expected *websocket.CloseError, got %v (%T)", err, err)
+	}
+	if closeErr.Code != websocket.CloseMessageTooBig {
+		t.Errorf("close code = %d, want %d", closeErr.Code, websocket.CloseMessageTooBig)
+	}
+}
+
+func TestWriteFramedArray(t *testing.T) {
+	srv, cli := newConnPair(t)
+	c := &Client{conn: srv, cfg: Config{WriteWait: writeWait}}
+
+	if !c.writeFramed([][]byte{[]byte(`{"a":1}`), []byte(`{"a":2}`)}) {
+		t.Fatal("writeFramed returned false")
+	}
+
+	_, data, err := cli.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if want := `[{"a":1},{"a":2}]`; string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+}
+
+func TestWriteFramedNDJSON(t *testing.T) {
+	srv, cli := newConnPair(t)
+	c := &Client{conn: srv, cfg: Config{Framing: FramingNDJSON, WriteWait: writeWait}}
+
+	if !c.writeFramed([][]byte{[]byte(`{"a":1}`), []byte(`{"a":2}`)}) {
+		t.Fatal("writeFramed returned false")
+	}
+
+	_, data, err := cli.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if want := "{\"a\":1}\n{\"a\":2}"; string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+}
+
+func TestWriteFramedSingle(t *testing.T) {
+	srv, cli := newConnPair(t)
+	c := &Client{conn: srv, cfg: Config{Framing: FramingSingle, WriteWait: writeWait}}
+
+	if !c.writeFramed([][]byte{[]byte(`{"a":1}`), []byte(`{"a":2}`)}) {
+		t.Fatal("writeFramed returned false")
+	}
+
+	for _, want := range []string{`{"a":1}`, `{"a":2}`} {
+		_, data, err := cli.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		if string(data) != want {
+			t.Errorf("got %q, want %q", data, want)
+		}
+	}
+}
+
+// TestSendAckAndErrIDLessAreFireAndForget exercises the ack/err correlation
+// contract: an empty ID means fire-and-forget, so neither sendAck nor
+// sendErr should queue a frame for the client to read.
+func TestSendAckAndErrIDLessAreFireAndForget(t *testing.T) {
+	c := &Client{name: "c", send: make(chan []byte, 4)}
+
+	c.sendAck("", "topic")
+	c.sendErr("", "topic", "boom")
+
+	select {
+	case b := <-c.send:
+		t.Fatalf("expected no frame queued for ID-less ack/err, got %q", b)
+	default:
+	}
+}
+
+func TestSendAckWithIDQueuesAckFrame(t *testing.T) {
+	c := &Client{name: "c", send: make(chan []byte, 4)}
+
+	c.sendAck("42", "topic")
+
+	select {
+	case b := <-c.send:
+		var m message
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if m.ID != "42" || m.Action != ack || m.Topic != "topic" {
+			t.Errorf("got %+v, want {ID:42 Action:ack Topic:topic}", m)
+		}
+	default:
+		t.Fatal("expected an ack frame to be queued")
+	}
+}
+
+func TestSendErrWithIDQueuesErrFrame(t *testing.T) {
+	c := &Client{name: "c", send: make(chan []byte, 4)}
+
+	c.sendErr("43", "topic", "boom")
+
+	select {
+	case b := <-c.send:
+		var m message
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if m.ID != "43" || m.Action != errAction || m.Payload != "boom" {
+			t.Errorf("got %+v, want {ID:43 Action:err Payload:boom}", m)
+		}
+	default:
+		t.Fatal("expected an err frame to be queued")
+	}
+}